@@ -0,0 +1,261 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// This file follows the same methodology Go's own regexp package uses to
+// check itself against RE2's exhaustive test log: generate every regexp over
+// a small atom/operator alphabet up to a bounded depth, and check that
+// FastRegexMatcher agrees with the reference regexp/regexp engine on every
+// input over a small alphabet. Any disagreement is a bug in one of the fast
+// paths in regexp.go.
+
+// exhaustiveAtoms are the leaves combined by genExhaustiveRegexes. `^` and
+// `$` are included so depth-3 combinations with `*`/`+`/`?`/`|`/concat
+// exercise anchors compositionally (e.g. `(?:^)|(?:a)`), not just as the two
+// fixed whole-pattern strings in exhaustiveTrickyPatterns.
+var exhaustiveAtoms = []string{"a", "b", ".", "[a-c]", "^", "$"}
+
+// exhaustiveGenCap bounds how many regexps genExhaustiveRegexes keeps per
+// depth, so the corpus stays a few hundred patterns instead of exploding
+// combinatorially.
+const exhaustiveGenCap = 120
+
+// genExhaustiveRegexes enumerates regexps built from exhaustiveAtoms,
+// concatenation, alternation (`|`) and the `*`, `+`, `?` quantifiers, up to
+// the given depth.
+func genExhaustiveRegexes(depth int) []string {
+	seen := map[string]bool{}
+	level := append([]string(nil), exhaustiveAtoms...)
+	for _, v := range level {
+		seen[v] = true
+	}
+	for d := 0; d < depth; d++ {
+		var next []string
+		add := func(v string) bool {
+			if len(next) >= exhaustiveGenCap {
+				return false
+			}
+			if seen[v] {
+				return true
+			}
+			seen[v] = true
+			next = append(next, v)
+			return true
+		}
+		for _, p := range level {
+			for _, op := range []string{"*", "+", "?"} {
+				if !add("(?:" + p + ")" + op) {
+					break
+				}
+			}
+		}
+		for _, p := range level {
+			for _, a := range exhaustiveAtoms {
+				if !add("(?:"+p+")(?:"+a+")") || !add("(?:"+p+")|(?:"+a+")") {
+					break
+				}
+			}
+		}
+		level = append(level, next...)
+	}
+	return level
+}
+
+// genExhaustiveInputs enumerates every string over {a, b, c} up to maxLen.
+func genExhaustiveInputs(maxLen int) []string {
+	inputs := []string{""}
+	alphabet := []byte{'a', 'b', 'c'}
+	cur := []string{""}
+	for i := 0; i < maxLen; i++ {
+		var next []string
+		for _, s := range cur {
+			for _, c := range alphabet {
+				next = append(next, s+string(c))
+			}
+		}
+		inputs = append(inputs, next...)
+		cur = next
+	}
+	return inputs
+}
+
+// exhaustiveTrickyPatterns is a checked-in corpus of patterns that have
+// historically been easy to get wrong in the fast paths above: nested
+// alternations, `(?i)` folded literals, negated classes, empty branches,
+// bare anchors and multi-`.*` concatenations.
+var exhaustiveTrickyPatterns = []string{
+	"(a|b|(c|d))",
+	"(?i)Foo|Bar",
+	"(?i)(foo|bar)baz",
+	"foo(?i)bar",
+	"[^0-9]",
+	"[^0-9]+",
+	"(|a)",
+	"(a|)",
+	"^$",
+	"^a$",
+	".*a.*b.*",
+	"a.*b.*c",
+	"(prometheus-.*|alertmanager-.*|node-exporter-.*)",
+	"host1|host2|host3|host4|host5",
+}
+
+// patternWordRe extracts the maximal runs of identifier-ish bytes (letters,
+// digits, '-', '_') out of a raw pattern string, e.g. "(?i)(foo|bar)baz"
+// yields ["i", "foo", "bar", "baz"]. Those are the bytes a pattern's own
+// literals are made of, as opposed to the generic {a, b, c} alphabet
+// genExhaustiveInputs draws from.
+var patternWordRe = regexp.MustCompile(`[A-Za-z0-9_-]+`)
+
+// swapCase flips the case of every ASCII letter in s, e.g. "Foo" -> "fOO".
+func swapCase(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// patternDerivedInputs builds inputs out of a pattern's own literal words
+// instead of a generic small alphabet, so that a tricky pattern built around
+// e.g. "foo"/"bar"/"host1" is actually exercised instead of passing
+// vacuously against inputs that share none of its bytes. For every word it
+// adds the word itself plus its upper/lower/swapped-case variants (to probe
+// `(?i)` handling) and their one-byte-short prefixes/suffixes (to probe
+// partial/overlapping matches), and also every pairwise concatenation of two
+// (possibly different) words, to probe multi-literal patterns like
+// `a.*b.*c` or `foo(?i)bar`.
+func patternDerivedInputs(pattern string) []string {
+	words := patternWordRe.FindAllString(pattern, -1)
+
+	seen := map[string]bool{}
+	var inputs []string
+	add := func(s string) {
+		if s == "" || seen[s] {
+			return
+		}
+		seen[s] = true
+		inputs = append(inputs, s)
+	}
+	variants := func(w string) []string {
+		return []string{w, strings.ToUpper(w), strings.ToLower(w), swapCase(w)}
+	}
+
+	for _, w := range words {
+		for _, v := range variants(w) {
+			add(v)
+			if len(v) > 1 {
+				add(v[:len(v)-1])
+				add(v[1:])
+			}
+		}
+	}
+	for _, a := range words {
+		for _, b := range words {
+			for _, va := range variants(a) {
+				for _, vb := range variants(b) {
+					add(va + vb)
+				}
+			}
+		}
+	}
+	return inputs
+}
+
+// checkAgreesWithReference asserts that FastRegexMatcher.MatchString agrees
+// with the reference regexp engine for every input, failing with a minimal
+// reproducer (the pattern and the first disagreeing input) otherwise.
+func checkAgreesWithReference(t *testing.T, pattern string, inputs []string) {
+	t.Helper()
+
+	ref, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		// Not every generated combination is a valid regexp (e.g. some
+		// quantifier nestings RE2 rejects); skip those.
+		return
+	}
+	fm, err := NewFastRegexMatcher(pattern)
+	if err != nil {
+		t.Fatalf("regexp %q: reference compiled but NewFastRegexMatcher failed: %s", pattern, err)
+	}
+
+	for _, s := range inputs {
+		want := ref.MatchString(s)
+		got := fm.MatchString(s)
+		if got != want {
+			t.Fatalf("regexp %q: MatchString(%q) = %v, want %v (reference regexp/regexp)", pattern, s, got, want)
+		}
+	}
+}
+
+func TestFastRegexMatcher_ExhaustiveAgreesWithReference(t *testing.T) {
+	inputs := genExhaustiveInputs(4)
+	for _, pattern := range genExhaustiveRegexes(3) {
+		pattern := pattern
+		t.Run(fmt.Sprintf("%q", pattern), func(t *testing.T) {
+			checkAgreesWithReference(t, pattern, inputs)
+		})
+	}
+}
+
+// exhaustiveLargeAlternationSize is sized past maxSetMatches, so
+// TestFastRegexMatcher_LargeAlternationAgreesWithReference exercises the
+// literal-prefix-plus-OpAlternate-tail recursion chunk0-3 added to
+// stringMatcherFromRegexp, not just the capped setMatches fast path.
+const exhaustiveLargeAlternationSize = maxSetMatches + 500
+
+func TestFastRegexMatcher_LargeAlternationAgreesWithReference(t *testing.T) {
+	hosts := make([]string, exhaustiveLargeAlternationSize)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d", i)
+	}
+	pattern := strings.Join(hosts, "|")
+
+	inputs := []string{
+		"host0",
+		fmt.Sprintf("host%d", exhaustiveLargeAlternationSize-1),
+		fmt.Sprintf("host%d", exhaustiveLargeAlternationSize),
+		fmt.Sprintf("host%dx", exhaustiveLargeAlternationSize/2),
+		"host",
+		"hostx",
+	}
+	checkAgreesWithReference(t, pattern, inputs)
+}
+
+func TestFastRegexMatcher_TrickyPatternsAgreeWithReference(t *testing.T) {
+	genericInputs := genExhaustiveInputs(4)
+	for _, pattern := range exhaustiveTrickyPatterns {
+		pattern := pattern
+		t.Run(fmt.Sprintf("%q", pattern), func(t *testing.T) {
+			// The generic {a, b, c} corpus alone shares no bytes with
+			// patterns built around literals like "foo"/"host1"/
+			// "prometheus-", so it'd pass vacuously for those; round it out
+			// with inputs derived from the pattern's own literals.
+			inputs := append(append([]string(nil), genericInputs...), patternDerivedInputs(pattern)...)
+			checkAgreesWithReference(t, pattern, inputs)
+		})
+	}
+}
@@ -14,20 +14,58 @@
 package labels
 
 import (
+	"fmt"
 	"regexp"
 	"regexp/syntax"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-const maxSetMatches = 256
+// maxSetMatches bounds how many equality matches findSetMatches will
+// enumerate before giving up and falling back to the regexp engine. Lookups
+// against a case-sensitive resulting set are O(1) (see setMatchesSet), so
+// for those this only bounds memory/construction cost, not match-time cost;
+// a case-insensitive set is scanned linearly by MatchString.
+const maxSetMatches = 1024
 
 type FastRegexMatcher struct {
 	re *regexp.Regexp
 
 	setMatches []string
-	prefix     string
-	suffix     string
-	contains   string
+	// setMatchesSet is a hash-set view of setMatches, built whenever the
+	// matches are all case sensitive, so MatchString can do an O(1) lookup
+	// instead of a linear scan. Nil when setMatches is case insensitive or
+	// empty.
+	setMatchesSet map[string]struct{}
+	// caseSensitive tells whether matches against setMatches should be
+	// performed case sensitively; prefix, suffix and contains carry their
+	// own flags below. It only applies when
+	// setMatches was built: a concatenation can mix folded and non-folded
+	// literals (e.g. `foo(?i)bar`), in which case no single flag describes
+	// the whole of setMatches and NewFastRegexMatcher leaves setMatches nil
+	// instead, see setMatchesFoldState.
+	caseSensitive bool
+
+	prefix                string
+	prefixCaseSensitive   bool
+	suffix                string
+	suffixCaseSensitive   bool
+	contains              string
+	containsCaseSensitive bool
+
+	// firstChar is a prefilter on the first rune of the candidate string,
+	// derived from the parsed regexp. It is nil if no useful prefilter could
+	// be derived (e.g. the regexp can start with any rune).
+	firstChar *firstCharMatcher
+
+	// stringMatcher is a third tier, tried after the set/prefix/suffix/
+	// contains/first-char prefilters and before m.re: a StringMatcher built
+	// from the parsed regexp that can decide patterns like `.*foo.*`,
+	// `foo.*bar` or `(a|b|c)xyz(d|e)` without ever calling m.re.MatchString.
+	// Nil if no such matcher could be built, in which case m.re is the only
+	// option left.
+	stringMatcher StringMatcher
 }
 
 func NewFastRegexMatcher(v string) (*FastRegexMatcher, error) {
@@ -42,25 +80,54 @@ func NewFastRegexMatcher(v string) (*FastRegexMatcher, error) {
 		return nil, err
 	}
 	m := &FastRegexMatcher{
-		re:         re,
-		setMatches: findSetMatches(parsed, ""),
+		re: re,
+	}
+
+	// findSetMatches concatenates literal runs verbatim, regardless of
+	// whether any of them carry `(?i)`; that's only a valid single string to
+	// compare against s if every literal that contributed to it agrees on
+	// case sensitivity. When they don't, leave setMatches nil and fall
+	// through to the slower tiers below instead of guessing.
+	if sawCaseSensitive, sawCaseInsensitive := setMatchesFoldState(parsed); !(sawCaseSensitive && sawCaseInsensitive) {
+		m.setMatches = findSetMatches(parsed, "")
+		m.caseSensitive = !sawCaseInsensitive
+	}
+
+	if len(m.setMatches) > 0 && m.caseSensitive {
+		m.setMatchesSet = make(map[string]struct{}, len(m.setMatches))
+		for _, match := range m.setMatches {
+			m.setMatchesSet[match] = struct{}{}
+		}
 	}
 
 	if parsed.Op == syntax.OpConcat {
-		m.prefix, m.suffix, m.contains = optimizeConcatRegex(parsed)
+		m.prefix, m.suffix, m.contains, m.prefixCaseSensitive, m.suffixCaseSensitive, m.containsCaseSensitive = optimizeConcatRegex(parsed)
+	}
+
+	if fs := firstRunes(parsed); !fs.unbounded {
+		m.firstChar = newFirstCharMatcher(fs.ranges)
 	}
 
+	m.stringMatcher = stringMatcherFromRegexp(parsed)
+
 	return m, nil
 }
 
+// StringMatcher returns the StringMatcher this FastRegexMatcher built for
+// its pattern, or nil if none could be built (in which case MatchString
+// falls back to the full regexp engine). Downstream projects can use this to
+// introspect a selector, e.g. to push an equality/prefix/contains check down
+// to a storage backend instead of evaluating the regexp per series.
+func (m *FastRegexMatcher) StringMatcher() StringMatcher {
+	return m.stringMatcher
+}
+
 // findSetMatches extract equality matches from a regexp.
 // Returns nil if we can't replace the regexp by only equality matchers.
+// The extracted matches may be case-folded (e.g. for a `(?i)` regexp); the
+// caller is expected to know whether to compare them case sensitively or
+// not, see FastRegexMatcher.caseSensitive.
 func findSetMatches(re *syntax.Regexp, base string) []string {
-	// Matches are case sensitive, if we find a case insensitive regexp.
-	// We have to abort.
-	if isCaseInsensitive(re) {
-		return nil
-	}
 	switch re.Op {
 	case syntax.OpLiteral:
 		return []string{base + string(re.Rune)}
@@ -179,39 +246,127 @@ func isCaseInsensitive(reg *syntax.Regexp) bool {
 	return (reg.Flags & syntax.FoldCase) != 0
 }
 
+// setMatchesFoldState walks the same literal/concat/alternate/capture shape
+// findSetMatches does, and reports whether it saw any case-sensitive and/or
+// any case-insensitive literal contributing to the result. Seeing both means
+// the concatenation mixes folded and non-folded literals (e.g.
+// `foo(?i)bar`), so no single case-sensitivity flag applies to the whole of
+// findSetMatches' output.
+func setMatchesFoldState(re *syntax.Regexp) (sawCaseSensitive, sawCaseInsensitive bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if len(re.Rune) == 0 {
+			return false, false
+		}
+		if isCaseInsensitive(re) {
+			return false, true
+		}
+		return true, false
+	case syntax.OpCapture:
+		clearCapture(re)
+		return setMatchesFoldState(re)
+	case syntax.OpConcat, syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			cs, ci := setMatchesFoldState(sub)
+			sawCaseSensitive = sawCaseSensitive || cs
+			sawCaseInsensitive = sawCaseInsensitive || ci
+		}
+		return sawCaseSensitive, sawCaseInsensitive
+	case syntax.OpCharClass:
+		// A class contributes its runes verbatim. Under `(?i)` the parser
+		// already lists every case variant, so either comparison agrees with
+		// it; otherwise its runes must be compared case sensitively.
+		return !isCaseInsensitive(re), false
+	default:
+		// OpEmptyMatch etc. don't carry a fold-sensitive literal of their
+		// own.
+		return false, false
+	}
+}
+
 // tooManyMatches guards against creating too many set matches
 func tooManyMatches(matches []string, new ...string) bool {
 	return len(matches)+len(new) > maxSetMatches
 }
 
 func (m *FastRegexMatcher) MatchString(s string) bool {
+	if m.setMatchesSet != nil {
+		_, ok := m.setMatchesSet[s]
+		return ok
+	}
 	if len(m.setMatches) != 0 {
 		for _, match := range m.setMatches {
-			if match == s {
+			if m.caseSensitive {
+				if match == s {
+					return true
+				}
+			} else if strings.EqualFold(match, s) {
 				return true
 			}
 		}
 		return false
 	}
-	if m.prefix != "" && !strings.HasPrefix(s, m.prefix) {
+	if m.firstChar != nil && !m.firstChar.matches(s) {
 		return false
 	}
-	if m.suffix != "" && !strings.HasSuffix(s, m.suffix) {
+	if m.prefix != "" && !hasPrefixFold(s, m.prefix, m.prefixCaseSensitive) {
 		return false
 	}
-	if m.contains != "" && !strings.Contains(s, m.contains) {
+	if m.suffix != "" && !hasSuffixFold(s, m.suffix, m.suffixCaseSensitive) {
 		return false
 	}
+	if m.contains != "" && !containsFold(s, m.contains, m.containsCaseSensitive) {
+		return false
+	}
+	if m.stringMatcher != nil {
+		return m.stringMatcher.Matches(s)
+	}
 	return m.re.MatchString(s)
 }
 
+// hasPrefixFold is like strings.HasPrefix, but compares case insensitively
+// when caseSensitive is false.
+func hasPrefixFold(s, prefix string, caseSensitive bool) bool {
+	if caseSensitive {
+		return strings.HasPrefix(s, prefix)
+	}
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// hasSuffixFold is like strings.HasSuffix, but compares case insensitively
+// when caseSensitive is false.
+func hasSuffixFold(s, suffix string, caseSensitive bool) bool {
+	if caseSensitive {
+		return strings.HasSuffix(s, suffix)
+	}
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// containsFold is like strings.Contains, but compares case insensitively
+// when caseSensitive is false.
+func containsFold(s, substr string, caseSensitive bool) bool {
+	if caseSensitive {
+		return strings.Contains(s, substr)
+	}
+	if len(substr) == 0 {
+		return true
+	}
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *FastRegexMatcher) SetMatches() []string {
 	return m.setMatches
 }
 
 // optimizeConcatRegex returns literal prefix/suffix text that can be safely
-// checked against the label value before running the regexp matcher.
-func optimizeConcatRegex(r *syntax.Regexp) (prefix, suffix, contains string) {
+// checked against the label value before running the regexp matcher, along
+// with whether each extracted literal must be compared case sensitively.
+func optimizeConcatRegex(r *syntax.Regexp) (prefix, suffix, contains string, prefixCaseSensitive, suffixCaseSensitive, containsCaseSensitive bool) {
 	sub := r.Sub
 
 	// We can safely remove begin and end text matchers respectively
@@ -229,20 +384,23 @@ func optimizeConcatRegex(r *syntax.Regexp) (prefix, suffix, contains string) {
 
 	// Given Prometheus regex matchers are always anchored to the begin/end
 	// of the text, if the first/last operations are literals, we can safely
-	// treat them as prefix/suffix.
-	if sub[0].Op == syntax.OpLiteral && (sub[0].Flags&syntax.FoldCase) == 0 {
+	// treat them as prefix/suffix, even if they were folded by `(?i)`.
+	if sub[0].Op == syntax.OpLiteral {
 		prefix = string(sub[0].Rune)
+		prefixCaseSensitive = !isCaseInsensitive(sub[0])
 	}
-	if last := len(sub) - 1; sub[last].Op == syntax.OpLiteral && (sub[last].Flags&syntax.FoldCase) == 0 {
+	if last := len(sub) - 1; sub[last].Op == syntax.OpLiteral {
 		suffix = string(sub[last].Rune)
+		suffixCaseSensitive = !isCaseInsensitive(sub[last])
 	}
 
 	// If contains any literal which is not a prefix/suffix, we keep the
 	// 1st one. We do not keep the whole list of literals to simplify the
 	// fast path.
 	for i := 1; i < len(sub)-1; i++ {
-		if sub[i].Op == syntax.OpLiteral && (sub[i].Flags&syntax.FoldCase) == 0 {
+		if sub[i].Op == syntax.OpLiteral {
 			contains = string(sub[i].Rune)
+			containsCaseSensitive = !isCaseInsensitive(sub[i])
 			break
 		}
 	}
@@ -250,31 +408,217 @@ func optimizeConcatRegex(r *syntax.Regexp) (prefix, suffix, contains string) {
 	return
 }
 
+// firstCharMatcher is a prefilter that tells whether a rune can possibly be
+// the first rune of a string matched by a regexp. It's cheap to evaluate
+// (an array lookup for ASCII, a short range scan otherwise) and lets
+// MatchString reject obviously non-matching inputs without ever touching the
+// backing regexp.Regexp.
+type firstCharMatcher struct {
+	// ascii[r] is true if the ASCII rune r can start a match.
+	ascii [utf8.RuneSelf]bool
+	// ranges holds closed [lo, hi] rune ranges, for runes >= utf8.RuneSelf,
+	// that can start a match. Stored as a flat slice of (lo, hi) pairs.
+	ranges []rune
+}
+
+// newFirstCharMatcher builds a firstCharMatcher out of a flat (lo, hi) rune
+// range slice, as produced by firstRunes.
+func newFirstCharMatcher(ranges []rune) *firstCharMatcher {
+	fc := &firstCharMatcher{}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo < utf8.RuneSelf {
+			asciiHi := hi
+			if asciiHi >= utf8.RuneSelf {
+				asciiHi = utf8.RuneSelf - 1
+			}
+			for c := lo; c <= asciiHi; c++ {
+				fc.ascii[c] = true
+			}
+		}
+		if hi >= utf8.RuneSelf {
+			rlo := lo
+			if rlo < utf8.RuneSelf {
+				rlo = utf8.RuneSelf
+			}
+			fc.ranges = append(fc.ranges, rlo, hi)
+		}
+	}
+	return fc
+}
+
+// matches reports whether s could possibly be matched, based solely on its
+// first rune. An empty string is always passed through, since the prefilter
+// has nothing to reject it on.
+func (fc *firstCharMatcher) matches(s string) bool {
+	if s == "" {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	if r < utf8.RuneSelf {
+		return fc.ascii[r]
+	}
+	for i := 0; i+1 < len(fc.ranges); i += 2 {
+		if r >= fc.ranges[i] && r <= fc.ranges[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// firstRuneSet describes the set of runes a (sub-)expression can start a
+// match with.
+type firstRuneSet struct {
+	// nullable is true if the (sub-)expression can match the empty string,
+	// meaning a concatenation must also consider what follows it.
+	nullable bool
+	// unbounded is true if the start set couldn't be bounded to a small
+	// alphabet (e.g. `.*`), in which case the whole prefilter must be
+	// disabled.
+	unbounded bool
+	// ranges holds a flat (lo, hi) pair list of runes the expression can
+	// start with. Meaningless when unbounded is true.
+	ranges []rune
+}
+
+// firstRunes walks the parsed regexp and computes the set of runes it can
+// possibly start a match with, so that FastRegexMatcher can cheaply reject
+// candidates that start with none of them. See firstRuneSet for how partial
+// results are combined by callers.
+func firstRunes(re *syntax.Regexp) firstRuneSet {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if len(re.Rune) == 0 {
+			return firstRuneSet{nullable: true}
+		}
+		r := re.Rune[0]
+		if !isCaseInsensitive(re) {
+			return firstRuneSet{ranges: []rune{r, r}}
+		}
+		var ranges []rune
+		r0 := r
+		for c := unicode.SimpleFold(r0); c != r0; c = unicode.SimpleFold(c) {
+			ranges = append(ranges, c, c)
+		}
+		ranges = append(ranges, r, r)
+		return firstRuneSet{ranges: ranges}
+	case syntax.OpCharClass:
+		return firstRuneSet{ranges: append([]rune(nil), re.Rune...)}
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return firstRuneSet{unbounded: true}
+	case syntax.OpEmptyMatch,
+		syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return firstRuneSet{nullable: true}
+	case syntax.OpNoMatch:
+		return firstRuneSet{}
+	case syntax.OpCapture:
+		return firstRunes(re.Sub[0])
+	case syntax.OpStar, syntax.OpQuest:
+		fs := firstRunes(re.Sub[0])
+		fs.nullable = true
+		return fs
+	case syntax.OpPlus:
+		// x+ requires at least one occurrence of x, so it's only nullable if
+		// that one required occurrence can itself match empty (e.g. a
+		// zero-width assertion like `(?:^)+`); we only need the start set of
+		// the first one, so take the first sub's set as-is rather than
+		// overriding it.
+		return firstRunes(re.Sub[0])
+	case syntax.OpConcat:
+		result := firstRuneSet{nullable: true}
+		for _, sub := range re.Sub {
+			fs := firstRunes(sub)
+			if fs.unbounded {
+				return firstRuneSet{unbounded: true}
+			}
+			result.ranges = append(result.ranges, fs.ranges...)
+			if !fs.nullable {
+				result.nullable = false
+				break
+			}
+		}
+		return result
+	case syntax.OpAlternate:
+		result := firstRuneSet{}
+		for _, sub := range re.Sub {
+			fs := firstRunes(sub)
+			if fs.unbounded {
+				return firstRuneSet{unbounded: true}
+			}
+			result.ranges = append(result.ranges, fs.ranges...)
+			if fs.nullable {
+				result.nullable = true
+			}
+		}
+		return result
+	default:
+		// Unknown/unhandled op (e.g. a surviving OpRepeat): don't risk a
+		// wrong rejection, just disable the prefilter.
+		return firstRuneSet{unbounded: true}
+	}
+}
+
+// StringMatcher matches a string against a (fragment of a) regexp without
+// going through the backing regexp.Regexp, and can describe itself for
+// debugging/introspection. FastRegexMatcher.StringMatcher exposes the one it
+// built for a given pattern, e.g. so a downstream storage engine can push
+// the selector down instead of re-evaluating it per series.
 type StringMatcher interface {
 	Matches(s string) bool
+	// String describes the matcher, e.g. for logging which fast path a
+	// given regexp selector took.
+	String() string
 }
 
 func stringMatcherFromRegexp(re *syntax.Regexp) StringMatcher {
 	clearCapture(re)
-	clearBeginEndText(re)
 	switch re.Op {
-	case syntax.OpStar:
+	case syntax.OpStar, syntax.OpPlus:
+		// Only `.*`/`.+`-style wildcards reduce to "matches anything"; a
+		// star/plus over anything else (e.g. `a*`) needs real repetition
+		// matching that StringMatcher doesn't implement, so bail out to the
+		// regexp fallback rather than over-match.
+		if !isAnyCharRepeat(re) {
+			return nil
+		}
 		return anyStringMatcher{
-			allowEmpty: true,
+			allowEmpty: re.Op == syntax.OpStar,
 			matchNL:    re.Flags&syntax.DotNL != 0,
 		}
 	case syntax.OpEmptyMatch:
 		return emptyStringMatcher{}
-	case syntax.OpPlus:
-		return anyStringMatcher{
-			allowEmpty: false,
-			matchNL:    re.Flags&syntax.DotNL != 0,
-		}
 	case syntax.OpLiteral:
 		return equalStringMatcher{
 			s:             string(re.Rune),
 			caseSensitive: !isCaseInsensitive(re),
 		}
+	case syntax.OpCharClass:
+		// Expand into one equalStringMatcher per rune, same as findSetMatches
+		// does for a set match; this is what lets a bare one-rune-long
+		// alternation branch (e.g. the "0"-"9" branch of
+		// `host0|host1|...|hostN`, which RE2 represents as a CharClass
+		// rather than a Concat) resolve to a StringMatcher instead of
+		// forcing its whole enclosing OpAlternate to bail out to m.re.
+		if len(re.Rune)%2 != 0 {
+			return nil
+		}
+		var totalSet int
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			totalSet += int(re.Rune[i+1]-re.Rune[i]) + 1
+		}
+		if totalSet > maxSetMatches {
+			return nil
+		}
+		or := make([]StringMatcher, 0, totalSet)
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			for c := lo; c <= hi; c++ {
+				or = append(or, equalStringMatcher{s: string(c), caseSensitive: true})
+			}
+		}
+		return newAlternateStringMatcher(or)
 	case syntax.OpAlternate:
 		or := make([]StringMatcher, 0, len(re.Sub))
 		for _, sub := range re.Sub {
@@ -284,8 +628,15 @@ func stringMatcherFromRegexp(re *syntax.Regexp) StringMatcher {
 			}
 			or = append(or, m)
 		}
-		return orStringMatcher(or)
+		return newAlternateStringMatcher(or)
 	case syntax.OpConcat:
+		// clearBeginEndText only makes sense here: it strips a leading/
+		// trailing anchor off a *sequence*, which is meaningless (and actively
+		// wrong) applied to re.Sub before we know re is a concatenation --
+		// e.g. for an OpAlternate, re.Sub holds branches, not a sequence, and
+		// stripping a trailing `$` branch off `(?:a)|(?:$)` would silently
+		// discard that whole alternative.
+		clearBeginEndText(re)
 		clearCapture(re.Sub...)
 		if len(re.Sub) == 0 {
 			return emptyStringMatcher{}
@@ -293,6 +644,21 @@ func stringMatcherFromRegexp(re *syntax.Regexp) StringMatcher {
 		if len(re.Sub) == 1 {
 			return stringMatcherFromRegexp(re.Sub[0])
 		}
+		// A literal, a `.*`/`.+` gap, then another literal (e.g. `foo.*bar`)
+		// doesn't fit the leading/trailing-wildcard shape handled below, but
+		// is just as common and just as cheap to check directly: a fixed
+		// prefix, a fixed suffix, and enough room between them for the gap.
+		if len(re.Sub) == 3 && re.Sub[0].Op == syntax.OpLiteral && re.Sub[2].Op == syntax.OpLiteral &&
+			(re.Sub[1].Op == syntax.OpStar || re.Sub[1].Op == syntax.OpPlus) && isAnyCharRepeat(re.Sub[1]) {
+			return literalGapStringMatcher{
+				prefix:              string(re.Sub[0].Rune),
+				prefixCaseSensitive: !isCaseInsensitive(re.Sub[0]),
+				suffix:              string(re.Sub[2].Rune),
+				suffixCaseSensitive: !isCaseInsensitive(re.Sub[2]),
+				allowEmptyGap:       re.Sub[1].Op == syntax.OpStar,
+				matchNL:             re.Sub[1].Flags&syntax.DotNL != 0,
+			}
+		}
 		var left, right StringMatcher
 
 		if re.Sub[0].Op == syntax.OpPlus || re.Sub[0].Op == syntax.OpStar {
@@ -309,63 +675,364 @@ func stringMatcherFromRegexp(re *syntax.Regexp) StringMatcher {
 			}
 			re.Sub = re.Sub[:len(re.Sub)-1]
 		}
+		// A literal prefix/suffix directly followed/preceded by an
+		// alternation (e.g. `host0|host1|...|hostN`, which RE2 factors into
+		// Concat[Literal("host"), Alternate(...)]) doesn't need flattening
+		// through the capped findSetMatches below: recurse into the
+		// alternation via stringMatcherFromRegexp, which builds on the
+		// uncapped OpAlternate case, and combine it with the literal
+		// directly instead of re-enumerating every branch up front.
+		if left == nil && right == nil && len(re.Sub) == 2 {
+			if m := stringMatcherForLiteralPlusAlternate(re.Sub[0], re.Sub[1]); m != nil {
+				return m
+			}
+		}
 		matches := findSetMatches(re, "")
+		if len(matches) == 0 {
+			return nil
+		}
+		// As in findSetMatches, matches is only a valid string to compare
+		// against s if every literal that contributed to it agrees on case
+		// sensitivity; bail out rather than guess when they don't.
+		sawCaseSensitive, sawCaseInsensitive := setMatchesFoldState(re)
+		if sawCaseSensitive && sawCaseInsensitive {
+			return nil
+		}
 		if left == nil && right == nil {
-			if len(matches) > 0 {
-				var or []StringMatcher
-				for _, match := range matches {
-					or = append(or, equalStringMatcher{
-						s:             match,
-						caseSensitive: true,
-					})
-				}
-				return orStringMatcher(or)
+			or := make([]StringMatcher, 0, len(matches))
+			for _, match := range matches {
+				or = append(or, equalStringMatcher{
+					s:             match,
+					caseSensitive: !sawCaseInsensitive,
+				})
 			}
+			return newAlternateStringMatcher(or)
 		}
-		if len(matches) > 0 {
-			return containsStringMatcher{
-				substr: matches,
-				left:   left,
-				right:  right,
-			}
+		// containsStringMatcher's Aho-Corasick automaton matches bytes
+		// exactly, so it can only be used for case-sensitive literals; a
+		// folded literal here must fall back to m.re instead.
+		if sawCaseInsensitive {
+			return nil
 		}
+		return newContainsStringMatcher(matches, left, right)
 	}
 	return nil
 }
 
+// stringMatcherForLiteralPlusAlternate builds a matcher for a two-sub concat
+// where one sub is a literal and the other is an alternation, in either
+// order (i.e. a literal prefix or suffix next to an OpAlternate tail, as in
+// RE2's factoring of `host0|host1|...|hostN` into
+// Concat[Literal("host"), Alternate(...)]). Returns nil if subA/subB aren't
+// that shape or the alternation itself couldn't be turned into a
+// StringMatcher.
+func stringMatcherForLiteralPlusAlternate(subA, subB *syntax.Regexp) StringMatcher {
+	lit, alt, litFirst := subA, subB, true
+	if lit.Op != syntax.OpLiteral {
+		lit, alt, litFirst = subB, subA, false
+	}
+	if lit.Op != syntax.OpLiteral || alt.Op != syntax.OpAlternate {
+		return nil
+	}
+	tail := stringMatcherFromRegexp(alt)
+	if tail == nil {
+		return nil
+	}
+	caseSensitive := !isCaseInsensitive(lit)
+	if litFirst {
+		return prefixTailStringMatcher{prefix: string(lit.Rune), caseSensitive: caseSensitive, tail: tail}
+	}
+	return suffixHeadStringMatcher{suffix: string(lit.Rune), caseSensitive: caseSensitive, head: tail}
+}
+
+// prefixTailStringMatcher matches a fixed prefix immediately followed by
+// whatever tail matches against the rest of s -- the shape a literal next to
+// a recursively-resolved OpAlternate tail needs. Unlike containsStringMatcher,
+// which only compares bytes exactly, the prefix may be case insensitive.
+type prefixTailStringMatcher struct {
+	prefix        string
+	caseSensitive bool
+	tail          StringMatcher
+}
+
+func (m prefixTailStringMatcher) Matches(s string) bool {
+	if !hasPrefixFold(s, m.prefix, m.caseSensitive) {
+		return false
+	}
+	return m.tail.Matches(s[len(m.prefix):])
+}
+
+func (m prefixTailStringMatcher) String() string {
+	return fmt.Sprintf("prefixTail(%q, tail=%v)", m.prefix, m.tail)
+}
+
+// suffixHeadStringMatcher is prefixTailStringMatcher's mirror image: a fixed
+// suffix immediately preceded by whatever head matches against the rest of
+// s.
+type suffixHeadStringMatcher struct {
+	suffix        string
+	caseSensitive bool
+	head          StringMatcher
+}
+
+func (m suffixHeadStringMatcher) Matches(s string) bool {
+	if !hasSuffixFold(s, m.suffix, m.caseSensitive) {
+		return false
+	}
+	return m.head.Matches(s[:len(s)-len(m.suffix)])
+}
+
+func (m suffixHeadStringMatcher) String() string {
+	return fmt.Sprintf("suffixHead(%q, head=%v)", m.suffix, m.head)
+}
+
+// newAlternateStringMatcher builds the matcher for an OpAlternate. When every
+// branch is a plain case-sensitive literal (the common case for series
+// selectors like `pod=~"a|b|c"`), it's backed by a hash set so MatchString is
+// O(1) regardless of how many branches there are. Otherwise, when every
+// branch is a case-sensitive literal prefix optionally followed by a tail, it
+// groups them with newPrefixTrieStringMatcher; failing that it falls back to
+// a plain linear scan of the branches.
+func newAlternateStringMatcher(branches []StringMatcher) StringMatcher {
+	if m := newHashStringMatcher(branches); m != nil {
+		return m
+	}
+	if m := newPrefixTrieStringMatcher(branches); m != nil {
+		return m
+	}
+	return orStringMatcher(branches)
+}
+
+// newHashStringMatcher returns a hashStringMatcher if every branch is a
+// plain case-sensitive literal, nil otherwise.
+func newHashStringMatcher(branches []StringMatcher) StringMatcher {
+	set := make(map[string]struct{}, len(branches))
+	for _, b := range branches {
+		eq, ok := b.(equalStringMatcher)
+		if !ok || !eq.caseSensitive {
+			return nil
+		}
+		set[eq.s] = struct{}{}
+	}
+	return hashStringMatcher(set)
+}
+
+// newPrefixTrieStringMatcher groups branches that share a fixed,
+// case-sensitive literal prefix (optionally followed by a tail matcher, e.g.
+// the `.*` in `prometheus-.*`) into a trie keyed by the prefix's first byte,
+// so MatchString only evaluates the branches consistent with s's first byte
+// instead of all of them. Returns nil if any branch isn't of that shape.
+func newPrefixTrieStringMatcher(branches []StringMatcher) StringMatcher {
+	children := make(map[byte][]prefixBranch)
+	for _, b := range branches {
+		var prefix string
+		var tail StringMatcher
+		switch v := b.(type) {
+		case equalStringMatcher:
+			if !v.caseSensitive {
+				return nil
+			}
+			prefix = v.s
+		case containsStringMatcher:
+			if v.left != nil || len(v.substr) != 1 {
+				return nil
+			}
+			prefix, tail = v.substr[0], v.right
+		default:
+			return nil
+		}
+		if prefix == "" {
+			return nil
+		}
+		children[prefix[0]] = append(children[prefix[0]], prefixBranch{prefix: prefix, tail: tail})
+	}
+	return prefixTrieStringMatcher(children)
+}
+
+// prefixTrieStringMatcher is the matcher built by newPrefixTrieStringMatcher.
+type prefixTrieStringMatcher map[byte][]prefixBranch
+
+type prefixBranch struct {
+	prefix string
+	// tail matches what follows prefix; nil means prefix must be the entire
+	// remainder of s.
+	tail StringMatcher
+}
+
+func (m prefixTrieStringMatcher) Matches(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, b := range m[s[0]] {
+		if len(s) < len(b.prefix) || s[:len(b.prefix)] != b.prefix {
+			continue
+		}
+		rest := s[len(b.prefix):]
+		if b.tail == nil {
+			if rest == "" {
+				return true
+			}
+			continue
+		}
+		if b.tail.Matches(rest) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m prefixTrieStringMatcher) String() string {
+	return fmt.Sprintf("prefixTrie(%d buckets)", len(m))
+}
+
+// hashStringMatcher matches a fixed set of case-sensitive literals in O(1).
+type hashStringMatcher map[string]struct{}
+
+func (m hashStringMatcher) Matches(s string) bool {
+	_, ok := m[s]
+	return ok
+}
+
+func (m hashStringMatcher) String() string {
+	return fmt.Sprintf("hashSet(%d literals)", len(m))
+}
+
+// newContainsStringMatcher builds the matcher for a set of literals next to a
+// `.*`/`.+`-style wildcard on one or both sides: with no left matcher the
+// literal must start s, with no right matcher it must end s. It is backed by
+// an Aho-Corasick automaton so that, regardless of how many literals are
+// being searched for, a single left-to-right pass over s finds every
+// candidate match position.
+func newContainsStringMatcher(substr []string, left, right StringMatcher) containsStringMatcher {
+	return containsStringMatcher{
+		substr: substr,
+		left:   left,
+		right:  right,
+		ac:     newAhoCorasick(substr),
+	}
+}
+
 type containsStringMatcher struct {
 	substr []string
 	left   StringMatcher
 	right  StringMatcher
+	ac     *ahoCorasick
 }
 
 func (m containsStringMatcher) Matches(s string) bool {
-	var pos int
-	for _, substr := range m.substr {
-		pos = strings.Index(s, substr)
-		if pos < 0 {
-			continue
+	found := false
+	m.ac.forEachMatch(s, func(pos, idx int) bool {
+		end := pos + len(m.substr[idx])
+		switch {
+		case m.left != nil && m.right != nil:
+			found = m.left.Matches(s[:pos]) && m.right.Matches(s[end:])
+		case m.left != nil:
+			found = end == len(s) && m.left.Matches(s[:pos])
+		case m.right != nil:
+			found = pos == 0 && m.right.Matches(s[end:])
+		default:
+			found = true
 		}
-		if m.right != nil && m.left != nil {
-			if m.left.Matches(s[:pos]) && m.right.Matches(s[pos+len(m.substr):]) {
-				return true
+		// Keep scanning while we haven't found a satisfying position yet.
+		return !found
+	})
+	return found
+}
+
+func (m containsStringMatcher) String() string {
+	return fmt.Sprintf("contains(%v, left=%v, right=%v)", m.substr, m.left, m.right)
+}
+
+// ahoCorasick finds, in a single left-to-right scan of the input, every
+// position where any of a fixed set of literal patterns occurs. It's the
+// standard Aho-Corasick automaton: a trie of the patterns plus failure links
+// so that a mismatch resumes from the longest proper suffix of what's been
+// matched so far that's also a prefix of some pattern, instead of restarting
+// from the root.
+type ahoCorasick struct {
+	patterns []string
+
+	// goTo[state][c] is the next state reached from state on byte c, or -1
+	// if there's no explicit trie edge (the failure link must be followed).
+	goTo [][256]int32
+	// fail[state] is the failure link: the state to fall back to when no
+	// trie edge matches.
+	fail []int32
+	// out[state] lists the indexes into patterns that end at state (via its
+	// failure chain).
+	out [][]int
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{patterns: patterns}
+	root := ac.newState()
+	for i, p := range patterns {
+		state := int32(0)
+		for j := 0; j < len(p); j++ {
+			c := p[j]
+			next := ac.goTo[state][c]
+			if next == -1 {
+				next = ac.newState()
+				ac.goTo[state][c] = next
 			}
-			continue
+			state = next
 		}
-		if m.left != nil {
-			if m.left.Matches(s[:pos]) {
-				return true
+		ac.out[state] = append(ac.out[state], i)
+	}
+
+	// Breadth-first traversal to compute failure links and to turn goTo into
+	// the full (Aho-Corasick "goto") automaton where every state has an edge
+	// for every byte.
+	queue := make([]int32, 0, len(ac.goTo))
+	for c := 0; c < 256; c++ {
+		if s := ac.goTo[root][c]; s != -1 {
+			ac.fail[s] = root
+			queue = append(queue, s)
+		} else {
+			ac.goTo[root][c] = root
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		ac.out[state] = append(ac.out[state], ac.out[ac.fail[state]]...)
+		for c := 0; c < 256; c++ {
+			next := ac.goTo[state][c]
+			if next == -1 {
+				ac.goTo[state][c] = ac.goTo[ac.fail[state]][c]
+				continue
 			}
-			continue
+			ac.fail[next] = ac.goTo[ac.fail[state]][c]
+			queue = append(queue, next)
 		}
-		if m.right != nil {
-			if m.right.Matches(s[pos+len(m.substr):]) {
-				return true
+	}
+	return ac
+}
+
+func (ac *ahoCorasick) newState() int32 {
+	var edges [256]int32
+	for c := range edges {
+		edges[c] = -1
+	}
+	ac.goTo = append(ac.goTo, edges)
+	ac.fail = append(ac.fail, 0)
+	ac.out = append(ac.out, nil)
+	return int32(len(ac.goTo) - 1)
+}
+
+// forEachMatch calls f(pos, patternIdx) for every occurrence of
+// patterns[patternIdx] in s, pos being the index where that occurrence
+// starts, scanning s once left to right, stopping early if f returns false.
+func (ac *ahoCorasick) forEachMatch(s string, f func(pos, patternIdx int) bool) {
+	state := int32(0)
+	for i := 0; i < len(s); i++ {
+		state = ac.goTo[state][s[i]]
+		for _, idx := range ac.out[state] {
+			if !f(i-len(ac.patterns[idx])+1, idx) {
+				return
 			}
-			continue
 		}
 	}
-	return false
 }
 
 type emptyStringMatcher struct{}
@@ -374,6 +1041,10 @@ func (m emptyStringMatcher) Matches(s string) bool {
 	return len(s) == 0
 }
 
+func (m emptyStringMatcher) String() string {
+	return "empty"
+}
+
 type orStringMatcher []StringMatcher
 
 func (m orStringMatcher) Matches(s string) bool {
@@ -385,18 +1056,29 @@ func (m orStringMatcher) Matches(s string) bool {
 	return false
 }
 
+func (m orStringMatcher) String() string {
+	return fmt.Sprintf("or%v", []StringMatcher(m))
+}
+
 type equalStringMatcher struct {
 	s             string
 	caseSensitive bool
 }
 
 func (m equalStringMatcher) Matches(s string) bool {
-	if !m.caseSensitive {
+	if m.caseSensitive {
 		return m.s == s
 	}
 	return strings.EqualFold(m.s, s)
 }
 
+func (m equalStringMatcher) String() string {
+	if m.caseSensitive {
+		return fmt.Sprintf("equal(%q)", m.s)
+	}
+	return fmt.Sprintf("equalFold(%q)", m.s)
+}
+
 type anyStringMatcher struct {
 	allowEmpty bool
 	matchNL    bool
@@ -411,3 +1093,58 @@ func (m anyStringMatcher) Matches(s string) bool {
 	}
 	return true
 }
+
+func (m anyStringMatcher) String() string {
+	if m.allowEmpty {
+		return "any(.*)"
+	}
+	return "any(.+)"
+}
+
+// isAnyCharRepeat tells whether re is a `.*`/`.+` style repeat, i.e. a
+// Star/Plus over a single AnyChar(NotNL) sub, as opposed to a repeat over
+// something else (e.g. `a*`) that StringMatcher doesn't model.
+func isAnyCharRepeat(re *syntax.Regexp) bool {
+	if len(re.Sub) != 1 {
+		return false
+	}
+	op := re.Sub[0].Op
+	return op == syntax.OpAnyChar || op == syntax.OpAnyCharNotNL
+}
+
+// literalGapStringMatcher matches a fixed prefix, an arbitrary gap, and a
+// fixed suffix, i.e. what a regexp like `foo.*bar` parses to: a literal that
+// can't be pulled to either edge of the concatenation because there's a
+// literal on both sides of the `.*`.
+type literalGapStringMatcher struct {
+	prefix              string
+	prefixCaseSensitive bool
+	suffix              string
+	suffixCaseSensitive bool
+	allowEmptyGap       bool // false for `.+`, true for `.*`
+	matchNL             bool // whether the gap may contain '\n'
+}
+
+func (m literalGapStringMatcher) Matches(s string) bool {
+	if len(s) < len(m.prefix)+len(m.suffix) {
+		return false
+	}
+	if !hasPrefixFold(s, m.prefix, m.prefixCaseSensitive) {
+		return false
+	}
+	if !hasSuffixFold(s, m.suffix, m.suffixCaseSensitive) {
+		return false
+	}
+	gap := s[len(m.prefix) : len(s)-len(m.suffix)]
+	if !m.allowEmptyGap && gap == "" {
+		return false
+	}
+	if !m.matchNL && strings.ContainsRune(gap, '\n') {
+		return false
+	}
+	return true
+}
+
+func (m literalGapStringMatcher) String() string {
+	return fmt.Sprintf("literalGap(prefix=%q, suffix=%q)", m.prefix, m.suffix)
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchmarkManyHosts builds a `host0|host1|...|hostN-1` alternation, the
+// shape chunk0-3 added a hash-set fast path for. Past maxSetMatches, RE2's
+// factored Concat[Literal("host"), Alternate(...)] shape no longer fits that
+// fast path and instead exercises the prefix/suffix-plus-alternate-tail
+// recursion in stringMatcherFromRegexp.
+func benchmarkManyHosts(n int) string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d", i)
+	}
+	return strings.Join(hosts, "|")
+}
+
+// BenchmarkFastRegexMatcher compares MatchString's fast paths against the
+// regexp.Regexp fallback they're meant to avoid, on a representative set of
+// selectors seen in real Prometheus queries.
+func BenchmarkFastRegexMatcher(b *testing.B) {
+	cases := []struct {
+		name, pattern, input string
+	}{
+		{"equal", "foo", "foo"},
+		{"alternate_small", "foo|bar|baz", "baz"},
+		{"alternate_large_hash_set", benchmarkManyHosts(512), "host500"},
+		{"alternate_past_max_set_matches", benchmarkManyHosts(2000), "host1999"},
+		{"prefix_wildcard", "foo.*", "foobarbazbazbaz"},
+		{"contains_wildcard", ".*foo.*", "xxxxfooxxxxbarxxxx"},
+		{"literal_gap", "foo.*bar", "fooxxxxxxxxxxxxbar"},
+		{"case_insensitive_alternate", "(?i)Foo|Bar", "FOO"},
+	}
+
+	for _, c := range cases {
+		m, err := NewFastRegexMatcher(c.pattern)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.name+"/fast", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = m.MatchString(c.input)
+			}
+		})
+		b.Run(c.name+"/regexp_fallback", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = m.re.MatchString(c.input)
+			}
+		})
+	}
+}